@@ -0,0 +1,215 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+// Command znode-hub relays WireFile/NodeFile updates between nodes
+// that joined the same wire over a WebSocketConn instead of a shared
+// ZK/etcd cluster.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	addr     = flag.String("addr", ":9402", "listen address")
+	wsPath   = flag.String("path", "/wire", "websocket endpoint")
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     func(r *http.Request) bool { return true },
+	}
+)
+
+type frame struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// client is one connected node.
+type client struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (c *client) send(f frame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// hub keeps the subscriber table, keyed by path (a WireFile or
+// NodeFile), and fans out every register/set it sees to subscribers.
+// A path ending in "/" is a directory subscription: the hub tracks
+// every register/set path it has seen under known, and whenever one
+// lands under a subscribed prefix it replies with the JSON-encoded
+// list of all known paths under that prefix, in place of the children
+// watch ZkConn/EtcdConn provide for InfoDir. Unlike those, known paths
+// are never dropped: a node that disconnects stays in every listing.
+type hub struct {
+	mu    sync.Mutex
+	subs  map[string]map[*client]bool
+	known map[string]bool
+}
+
+func newHub() *hub {
+	return &hub{
+		subs:  make(map[string]map[*client]bool),
+		known: make(map[string]bool),
+	}
+}
+
+func (h *hub) subscribe(path string, c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, ok := h.subs[path]
+	if !ok {
+		m = make(map[*client]bool)
+		h.subs[path] = m
+	}
+	m[c] = true
+}
+
+func (h *hub) unsubscribe(path string, c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[path], c)
+}
+
+func (h *hub) unsubscribeAll(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, m := range h.subs {
+		delete(m, c)
+	}
+}
+
+func (h *hub) publish(path string, data []byte) {
+	h.mu.Lock()
+	subscribers := make([]*client, 0, len(h.subs[path]))
+	for c := range h.subs[path] {
+		subscribers = append(subscribers, c)
+	}
+	h.mu.Unlock()
+	f := frame{Op: "value", Path: path, Data: data}
+	for _, c := range subscribers {
+		if err := c.send(f); err != nil {
+			log.Printf("znode-hub: publish to %s: %v", path, err)
+		}
+	}
+}
+
+// noteKnown records path as seen and refreshes every directory
+// subscription it falls under.
+func (h *hub) noteKnown(path string) {
+	h.mu.Lock()
+	h.known[path] = true
+	var dirs []string
+	for prefix := range h.subs {
+		if strings.HasSuffix(prefix, "/") && strings.HasPrefix(path, prefix) {
+			dirs = append(dirs, prefix)
+		}
+	}
+	h.mu.Unlock()
+	for _, dir := range dirs {
+		h.publishDir(dir)
+	}
+}
+
+// publishDir sends every dir subscriber the current JSON-encoded list
+// of known paths under dir.
+func (h *hub) publishDir(dir string) {
+	h.mu.Lock()
+	var paths []string
+	for path := range h.known {
+		if strings.HasPrefix(path, dir) {
+			paths = append(paths, path)
+		}
+	}
+	h.mu.Unlock()
+	data, err := json.Marshal(paths)
+	if err != nil {
+		log.Printf("znode-hub: marshal listing for %s: %v", dir, err)
+		return
+	}
+	h.publish(dir, data)
+}
+
+func (h *hub) serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("znode-hub: upgrade: %v", err)
+		return
+	}
+	c := &client{conn: conn}
+	conn.SetPongHandler(func(string) error { return nil })
+	defer func() {
+		h.unsubscribeAll(c)
+		conn.Close()
+	}()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var f frame
+		if err := json.Unmarshal(data, &f); err != nil {
+			continue
+		}
+		switch f.Op {
+		case "watch":
+			h.subscribe(f.Path, c)
+			if strings.HasSuffix(f.Path, "/") {
+				h.publishDir(f.Path)
+			}
+		case "unwatch":
+			h.unsubscribe(f.Path, c)
+		case "register", "set":
+			h.publish(f.Path, f.Data)
+			h.noteKnown(f.Path)
+		}
+	}
+}
+
+func (h *hub) pingAll(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.Lock()
+		clients := make(map[*client]bool)
+		for _, m := range h.subs {
+			for c := range m {
+				clients[c] = true
+			}
+		}
+		h.mu.Unlock()
+		for c := range clients {
+			c.writeMu.Lock()
+			c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
+			c.writeMu.Unlock()
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	h := newHub()
+	go h.pingAll(30 * time.Second)
+	http.HandleFunc(*wsPath, h.serveWS)
+	log.Printf("znode-hub: listening on %s%s", *addr, *wsPath)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -0,0 +1,50 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import "time"
+
+// Conn abstracts the coordination backend a ZNode registers against.
+// Register advertises the node under file, Set publishes data at file
+// and Watch streams the value at file into watcher, returning once it
+// has delivered (or failed to deliver) a single update, or once done is
+// closed - whichever comes first. A nil done never fires, for the
+// common case of a watch meant to run for the life of the Conn. Unwatch
+// tells the backend that the caller is done watching file for good, so
+// backends that cache a watch/subscription per path (EtcdConn,
+// WebSocketConn) can retire it instead of holding it open for the life
+// of the Conn; backends that don't cache (ZkConn) treat it as a no-op.
+// ZNode.Start, ZNode.loop and ZNode.Request only ever talk to this
+// interface, so any backend that implements it can be plugged in with
+// AddConn.
+type Conn interface {
+	Register(file string, data []byte) error
+	Set(file string, data []byte) error
+	Watch(file string, watcher chan []byte, done <-chan struct{}) error
+	Unwatch(file string) error
+	Close() error
+}
+
+// Backend selects which Conn implementation NewConn builds.
+type Backend int
+
+const (
+	BackendZooKeeper Backend = iota
+	BackendEtcd
+)
+
+// NewConn builds a Conn for the given backend, passing endpoints and
+// timeout straight to NewEtcdConn or NewZkConn; any backend other than
+// BackendEtcd gets a ZkConn. Neither constructor takes further options:
+// the etcd lease TTL is the fixed etcdLeaseTTL.
+func NewConn(backend Backend, endpoints []string, timeout time.Duration) (Conn, error) {
+	switch backend {
+	case BackendEtcd:
+		return NewEtcdConn(endpoints, timeout)
+	default:
+		return NewZkConn(endpoints, timeout)
+	}
+}
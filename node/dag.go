@@ -0,0 +1,115 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// ContentID derives the 16-byte content id of an encoded ZFunc payload,
+// used both to stamp outgoing messages' causal history and to key the
+// MiniDag on receipt.
+func ContentID(data []byte) [16]byte {
+	sum := sha256.Sum256(data)
+	var id [16]byte
+	copy(id[:], sum[:16])
+	return id
+}
+
+// delivery pairs a message with the content id it was offered under.
+type delivery struct {
+	id [16]byte
+	fn ZFunc
+}
+
+type pendingMsg struct {
+	fn      ZFunc
+	arrived time.Time
+}
+
+// MiniDag buffers causally-ordered messages until every id in their
+// Past has already been delivered, the same check DERO uses for its
+// miniblock DAG: a message colliding with one of its own ancestors is
+// rejected outright.
+type MiniDag struct {
+	mu        sync.Mutex
+	delivered map[[16]byte]time.Time
+	pending   map[[16]byte]*pendingMsg
+}
+
+// NewMiniDag creates an empty MiniDag.
+func NewMiniDag() *MiniDag {
+	return &MiniDag{
+		delivered: make(map[[16]byte]time.Time),
+		pending:   make(map[[16]byte]*pendingMsg),
+	}
+}
+
+// Offer records fn under id and returns every message - possibly
+// including fn itself, possibly others that were waiting on it - that
+// is now ready for delivery because all of its ancestors have been
+// delivered.
+func (d *MiniDag) Offer(id [16]byte, fn ZFunc) ([]delivery, error) {
+	for i := 0; i < int(fn.PastCount); i++ {
+		if fn.Past[i] == id {
+			return nil, ErrCausalCollision
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.delivered[id]; ok {
+		return nil, nil
+	}
+	d.pending[id] = &pendingMsg{fn: fn, arrived: time.Now()}
+	return d.release(), nil
+}
+
+func (d *MiniDag) isReady(fn ZFunc) bool {
+	for i := 0; i < int(fn.PastCount); i++ {
+		if _, ok := d.delivered[fn.Past[i]]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// release repeatedly scans pending for messages whose ancestors are
+// all delivered until a full pass makes no further progress.
+func (d *MiniDag) release() (ready []delivery) {
+	for progress := true; progress; {
+		progress = false
+		for id, p := range d.pending {
+			if !d.isReady(p.fn) {
+				continue
+			}
+			delete(d.pending, id)
+			d.delivered[id] = time.Now()
+			ready = append(ready, delivery{id: id, fn: p.fn})
+			progress = true
+		}
+	}
+	return
+}
+
+// PurgeOlderThan drops delivered/pending bookkeeping older than age so
+// a long-running node's dag doesn't grow without bound.
+func (d *MiniDag) PurgeOlderThan(age time.Duration) {
+	cutoff := time.Now().Add(-age)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, t := range d.delivered {
+		if t.Before(cutoff) {
+			delete(d.delivered, id)
+		}
+	}
+	for id, p := range d.pending {
+		if p.arrived.Before(cutoff) {
+			delete(d.pending, id)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import "testing"
+
+func TestMiniDagDeliversReadyMessage(t *testing.T) {
+	d := NewMiniDag()
+	id := ContentID([]byte("msg"))
+	ready, err := d.Offer(id, ZFunc{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ready) != 1 || ready[0].id != id {
+		t.Fatalf("Offer with no Past = %v, want a single ready delivery", ready)
+	}
+}
+
+func TestMiniDagWithholdsUntilAncestorsDelivered(t *testing.T) {
+	d := NewMiniDag()
+	parentID := ContentID([]byte("parent"))
+	childID := ContentID([]byte("child"))
+
+	child := ZFunc{Name: "child", Past: [2][16]byte{parentID}, PastCount: 1}
+	ready, err := d.Offer(childID, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ready) != 0 {
+		t.Fatalf("Offer(child) before its parent arrived = %v, want none ready", ready)
+	}
+
+	ready, err = d.Offer(parentID, ZFunc{Name: "parent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ready) != 2 {
+		t.Fatalf("Offer(parent) = %v, want parent and the now-ready child", ready)
+	}
+}
+
+func TestMiniDagRejectsSelfReference(t *testing.T) {
+	d := NewMiniDag()
+	id := ContentID([]byte("msg"))
+	fn := ZFunc{Name: "a", Past: [2][16]byte{id}, PastCount: 1}
+	if _, err := d.Offer(id, fn); err != ErrCausalCollision {
+		t.Fatalf("Offer with id in its own Past = %v, want ErrCausalCollision", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Encoding encodes and decodes the values published onto a wire. Tag
+// identifies the codec in the wire format's leading byte, so a reader
+// can pick the matching Encoding without any prior negotiation with
+// the writer.
+type Encoding interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+	Tag() byte
+}
+
+// TagJSON is the codec tag for JSON, the Encoding used when
+// ZNode.Coder is left unset and the fallback decodeTagged uses for
+// payloads published before codec tagging existed.
+const TagJSON byte = 0x00
+
+// JSON is the Encoding used when ZNode.Coder is left unset.
+type JSON struct{}
+
+func (JSON) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSON) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (JSON) Tag() byte { return TagJSON }
+
+var (
+	encodingMu sync.RWMutex
+	encodings  = map[byte]Encoding{TagJSON: JSON{}}
+)
+
+// RegisterEncoding makes e available to decodeTagged under its own
+// Tag(). name is used only in the error returned on a tag collision.
+func RegisterEncoding(name string, e Encoding) error {
+	encodingMu.Lock()
+	defer encodingMu.Unlock()
+	if existing, ok := encodings[e.Tag()]; ok {
+		return fmt.Errorf("node: encoding tag %#x already registered (%T), cannot register %s", e.Tag(), existing, name)
+	}
+	encodings[e.Tag()] = e
+	return nil
+}
+
+func encodingByTag(tag byte) (Encoding, bool) {
+	encodingMu.RLock()
+	defer encodingMu.RUnlock()
+	e, ok := encodings[tag]
+	return e, ok
+}
+
+// encodeTagged encodes v with e and prefixes the result with e.Tag()
+// so heterogeneous producers/consumers sharing a wire can coexist.
+func encodeTagged(e Encoding, v interface{}) ([]byte, error) {
+	if e == nil {
+		e = JSON{}
+	}
+	data, err := e.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{e.Tag()}, data...), nil
+}
+
+// decodeTagged reads data's leading codec tag and decodes the
+// remainder with the matching registered Encoding, falling back to
+// plain JSON when the tag is missing or unrecognized - which is always
+// true for payloads published before codec tagging existed.
+func decodeTagged(data []byte, v interface{}) error {
+	if len(data) > 0 {
+		if e, ok := encodingByTag(data[0]); ok {
+			return e.Decode(data[1:], v)
+		}
+	}
+	return JSON{}.Decode(data, v)
+}
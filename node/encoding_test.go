@@ -0,0 +1,72 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import "testing"
+
+const tagTest byte = 0x7f
+
+type testEncoding struct{}
+
+func (testEncoding) Encode(v interface{}) ([]byte, error) {
+	s := v.(*string)
+	return []byte(*s), nil
+}
+
+func (testEncoding) Decode(data []byte, v interface{}) error {
+	s := v.(*string)
+	*s = string(data)
+	return nil
+}
+
+func (testEncoding) Tag() byte { return tagTest }
+
+func TestEncodeDecodeTaggedRoundTrip(t *testing.T) {
+	if err := RegisterEncoding("test", testEncoding{}); err != nil {
+		t.Fatal(err)
+	}
+
+	in := "hello"
+	data, err := encodeTagged(testEncoding{}, &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != tagTest {
+		t.Fatalf("encodeTagged did not prefix the encoding's tag: got %#x", data[0])
+	}
+
+	var out string
+	if err := decodeTagged(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Fatalf("decodeTagged round-trip = %q, want %q", out, in)
+	}
+}
+
+func TestDecodeTaggedFallsBackToJSON(t *testing.T) {
+	data, err := JSON{}.Encode("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out string
+	if err := decodeTagged(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != "plain" {
+		t.Fatalf("decodeTagged fallback = %q, want %q", out, "plain")
+	}
+}
+
+func TestEncodeTaggedNilEncodingUsesJSON(t *testing.T) {
+	data, err := encodeTagged(nil, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != TagJSON {
+		t.Fatalf("encodeTagged(nil, ...) tag = %#x, want TagJSON", data[0])
+	}
+}
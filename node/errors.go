@@ -0,0 +1,33 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import "errors"
+
+// ErrConnection is returned by a Conn once it has exhausted its retry
+// budget and the underlying connection cannot be recovered.
+var ErrConnection = errors.New("node: connection lost")
+
+// ErrNoOwner is returned by SetOnKey when the hash ring has no
+// registered members yet.
+var ErrNoOwner = errors.New("node: no owner for key")
+
+// ErrTimeout is returned by Request when no reply arrives within the
+// given timeout.
+var ErrTimeout = errors.New("node: request timeout")
+
+// ErrCausalCollision is returned when a causally-ordered message lists
+// its own content id among its Past references.
+var ErrCausalCollision = errors.New("node: message collides with its own causal history")
+
+// ErrBadPastCount is returned when a decoded ZFunc's PastCount exceeds
+// the capacity of its fixed-size Past array.
+var ErrBadPastCount = errors.New("node: past count exceeds capacity")
+
+// ErrorHandlerFunc receives errors surfaced from background goroutines
+// (watch loops, the dispatch loop, RPC dispatch) that have no caller to
+// return to.
+type ErrorHandlerFunc func(error)
@@ -0,0 +1,254 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	etcdLeaseTTL    = 10 // seconds
+	etcdDialTimeout = 5 * time.Second
+)
+
+// EtcdConn is the etcd v3-backed Conn. Register binds infoFile to a
+// lease kept alive for as long as the node runs, Set is a plain Put on
+// nodeFile/WireFile, and Watch streams value bytes from etcd's Watch
+// API into the caller's channel.
+type EtcdConn struct {
+	client *clientv3.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	errMu     sync.Mutex
+	errCounts map[string]int
+
+	watchMu sync.Mutex
+	watches map[string]*etcdWatch
+}
+
+// etcdWatch is one entry in EtcdConn.watches: ch is shared by every
+// caller currently watching file, and cancel tears down the
+// clientv3.Watch stream backing it once Unwatch retires the path.
+type etcdWatch struct {
+	ch     chan []byte
+	cancel context.CancelFunc
+}
+
+// NewEtcdConn dials the given etcd endpoints.
+func NewEtcdConn(endpoints []string, timeout time.Duration) (c *EtcdConn, err error) {
+	if timeout <= 0 {
+		timeout = etcdDialTimeout
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EtcdConn{
+		client:    client,
+		ctx:       ctx,
+		cancel:    cancel,
+		errCounts: make(map[string]int),
+		watches:   make(map[string]*etcdWatch),
+	}, nil
+}
+
+func (c *EtcdConn) Register(file string, data []byte) error {
+	lease, err := c.client.Grant(c.ctx, etcdLeaseTTL)
+	if err != nil {
+		return c.retry(file, err)
+	}
+	if _, err = c.client.Put(c.ctx, file, string(data), clientv3.WithLease(lease.ID)); err != nil {
+		return c.retry(file, err)
+	}
+	keepAlive, err := c.client.KeepAlive(c.ctx, lease.ID)
+	if err != nil {
+		return c.retry(file, err)
+	}
+	go drainKeepAlive(keepAlive)
+	return c.retry(file, nil)
+}
+
+// drainKeepAlive consumes lease renewal responses for as long as the
+// lease lives; clientv3 renews on read, so there is nothing else to do.
+func drainKeepAlive(ch <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range ch {
+	}
+}
+
+func (c *EtcdConn) Set(file string, data []byte) error {
+	_, err := c.client.Put(c.ctx, file, string(data))
+	return c.retry(file, err)
+}
+
+// Watch delivers a single update at file, reusing one long-lived etcd
+// watch stream per path for the life of the EtcdConn rather than
+// opening a new one on every call - node.watch() calls Watch again for
+// every delivered value, so a fresh clientv3.Watch per call would leak
+// a watch stream per event over the life of a long-running node. A
+// file ending in "/" is treated as a directory: Watch delivers the
+// JSON-encoded list of full keys under that prefix whenever it
+// changes, which is how ZNode discovers registered members under
+// InfoDir. Watch returns nil early once done is closed (a nil done
+// never fires), without tearing down the shared stream - another
+// caller may still be waiting on it. Callers that know they are the
+// only watcher left on file, such as Request's one-shot reply path,
+// should call Unwatch once they are done to retire the stream instead
+// of leaving it open for the life of the EtcdConn.
+func (c *EtcdConn) Watch(file string, watcher chan []byte, done <-chan struct{}) error {
+	ch := c.watchChan(file)
+	select {
+	case data, ok := <-ch:
+		if !ok {
+			return c.retry(file, ErrConnection)
+		}
+		watcher <- data
+		return c.retry(file, nil)
+	case <-c.ctx.Done():
+		return ErrConnection
+	case <-done:
+		return nil
+	}
+}
+
+// Unwatch retires file's shared watch stream, if any, canceling the
+// underlying clientv3.Watch and dropping it from the cache so the next
+// Watch call on file opens a fresh one. It is a no-op if file isn't
+// currently being watched.
+func (c *EtcdConn) Unwatch(file string) error {
+	c.watchMu.Lock()
+	w, ok := c.watches[file]
+	if ok {
+		delete(c.watches, file)
+	}
+	c.watchMu.Unlock()
+	if ok {
+		w.cancel()
+	}
+	return nil
+}
+
+func (c *EtcdConn) watchChan(file string) chan []byte {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+	if w, ok := c.watches[file]; ok {
+		return w.ch
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	ch := make(chan []byte, QUEUE_SIZE)
+	c.watches[file] = &etcdWatch{ch: ch, cancel: cancel}
+	if strings.HasSuffix(file, "/") {
+		go c.watchPrefix(ctx, file, ch)
+	} else {
+		go c.watchLoop(ctx, file, ch)
+	}
+	return ch
+}
+
+func (c *EtcdConn) watchLoop(ctx context.Context, file string, ch chan []byte) {
+	defer close(ch)
+	wc := c.client.Watch(ctx, file)
+	for resp := range wc {
+		if err := resp.Err(); err != nil {
+			return
+		}
+		for _, ev := range resp.Events {
+			select {
+			case ch <- ev.Kv.Value:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// watchPrefix pushes the current list of keys under prefix every time
+// that set changes, starting with the keys present right away so a
+// watcher doesn't have to wait for the next join/leave to see members
+// that already registered.
+func (c *EtcdConn) watchPrefix(ctx context.Context, prefix string, ch chan []byte) {
+	defer close(ch)
+	if data, err := c.listPrefix(prefix); err == nil {
+		select {
+		case ch <- data:
+		case <-ctx.Done():
+			return
+		}
+	}
+	wc := c.client.Watch(ctx, prefix, clientv3.WithPrefix())
+	for resp := range wc {
+		if err := resp.Err(); err != nil {
+			return
+		}
+		data, err := c.listPrefix(prefix)
+		if err != nil {
+			continue
+		}
+		select {
+		case ch <- data:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *EtcdConn) listPrefix(prefix string) ([]byte, error) {
+	resp, err := c.client.Get(c.ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		keys[i] = string(kv.Key)
+	}
+	return json.Marshal(keys)
+}
+
+func (c *EtcdConn) Close() error {
+	c.cancel()
+	return c.client.Close()
+}
+
+// retry tracks consecutive failures per file and turns err into
+// ErrConnection once MaxErrorCount is reached for that file, backing
+// off before returning a recoverable error so callers looping on
+// Watch/Set don't spin. Counting per file, rather than on a single
+// shared counter, keeps a failure burst on one path (e.g. watchSelf)
+// from tripping ErrConnection for unrelated calls on other paths.
+func (c *EtcdConn) retry(file string, err error) error {
+	c.errMu.Lock()
+	if err == nil {
+		delete(c.errCounts, file)
+		c.errMu.Unlock()
+		return nil
+	}
+	c.errCounts[file]++
+	count := c.errCounts[file]
+	c.errMu.Unlock()
+	if count >= MaxErrorCount {
+		return ErrConnection
+	}
+	time.Sleep(etcdBackoff(count))
+	return err
+}
+
+func etcdBackoff(attempt int) time.Duration {
+	d := time.Duration(attempt*attempt) * 100 * time.Millisecond
+	if d > 5*time.Second {
+		d = 5 * time.Second
+	}
+	return d
+}
@@ -0,0 +1,33 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"errors"
+
+	"github.com/mikespook/golib/iptpool"
+)
+
+// errNoInterpreter is returned by luaIpt.Exec: this snapshot doesn't
+// vendor a Lua interpreter yet, so there is nothing to run a bound
+// name against.
+var errNoInterpreter = errors.New("node: no Lua interpreter configured")
+
+// luaIpt is the ScriptIpt NewLuaIpt hands node.iptPool until a real
+// interpreter is wired in behind it; Init/Bind/Final are no-ops and
+// Exec always fails.
+type luaIpt struct{}
+
+// NewLuaIpt is the iptpool.CreateFunc ZNode.iptPool is built with.
+func NewLuaIpt() iptpool.ScriptIpt { return luaIpt{} }
+
+func (luaIpt) Init(path string) error { return nil }
+
+func (luaIpt) Final() error { return nil }
+
+func (luaIpt) Bind(name string, fn interface{}) error { return nil }
+
+func (luaIpt) Exec(name string, params interface{}) error { return errNoInterpreter }
@@ -0,0 +1,31 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// TagMsgpack is the codec tag Msgpack registers itself under.
+const TagMsgpack byte = 0x01
+
+// Msgpack is an Encoding backed by MessagePack, for producers/consumers
+// that want a denser wire format than JSON.
+type Msgpack struct{}
+
+func (Msgpack) Encode(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (Msgpack) Decode(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+func (Msgpack) Tag() byte { return TagMsgpack }
+
+func init() {
+	if err := RegisterEncoding("msgpack", Msgpack{}); err != nil {
+		panic(err)
+	}
+}
@@ -10,7 +10,11 @@ import (
 	"github.com/mikespook/golib/funcmap"
 	"github.com/mikespook/golib/iptpool"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,7 +24,9 @@ const (
 	Root          = "/z-node"
 	WireFile      = Root + "/%s/wire"
 	NodeFile      = Root + "/node/%s/%d"
-	InfoFile      = Root + "/info/%s/%d"
+	InfoFile      = Root + "/info/%s!%d"
+	InfoDir       = Root + "/info/"
+	ReplyFile     = Root + "/reply/%s/%d/%d"
 	QUEUE_SIZE    = 16
 )
 
@@ -36,11 +42,37 @@ type ZNode struct {
 	nodeFile, infoFile string
 	fmap               funcmap.Funcs
 	w                  sync.WaitGroup
+
+	ring    *HashRing
+	members map[string]bool
+
+	reqSeq uint64
+
+	causal    bool
+	dag       *MiniDag
+	lastMu    sync.Mutex
+	lastIDs   [2][16]byte
+	lastCount uint8
 }
 
 type ZFunc struct {
 	Name   string
 	Params interface{}
+
+	// ReplyTo, if set, is the path the dispatcher writes its result to
+	// once Name has been invoked; ReqID identifies the request that
+	// reply corresponds to. Both are left zero for fire-and-forget
+	// calls made through SetOnWire/SetOnSelf/Set.
+	ReplyTo string `json:",omitempty"`
+	ReqID   uint64 `json:",omitempty"`
+
+	// Past references the one or two message ids the producer had
+	// last observed when it published this message, and PastCount says
+	// how many of them are set. They are only populated when the
+	// producer has EnableCausal(true); a receiver with causal ordering
+	// off ignores them.
+	Past      [2][16]byte `json:",omitempty"`
+	PastCount uint8       `json:",omitempty"`
 }
 
 func MakeWire(region string) string {
@@ -69,6 +101,9 @@ func New(hostname string, regions ...string) (node *ZNode) {
 		watcher:  make(chan []byte, QUEUE_SIZE),
 		conns:    make([]Conn, 0),
 		iptPool:  iptpool.NewIptPool(NewLuaIpt),
+		ring:     NewHashRing(DefaultReplicas),
+		members:  make(map[string]bool),
+		Coder:    JSON{},
 	}
 }
 
@@ -89,14 +124,17 @@ func (node *ZNode) AddConn(conn Conn) (err error) {
 func (node *ZNode) Start(scriptPath string) {
 	node.watchSelf()
 	node.watchWire()
+	node.watchMembers()
 	node.iptPool.OnCreate = func(ipt iptpool.ScriptIpt) error {
 		ipt.Init(scriptPath)
 		ipt.Bind("SetOnWire", func(regine, name string, params interface{}) (err error) {
 			f := &ZFunc{Name: name, Params: params}
-			data, err := node.Coder.Encode(f)
+			node.stampCausal(f)
+			data, err := encodeTagged(node.Coder, f)
 			if err != nil {
 				return
 			}
+			node.observe(ContentID(data))
 			for _, conn := range node.conns {
 				if regine == "*" {
 					for _, r := range node.wires {
@@ -114,7 +152,7 @@ func (node *ZNode) Start(scriptPath string) {
 		})
 		ipt.Bind("SetOnSelf", func(name string, params interface{}) (err error) {
 			f := &ZFunc{Name: name, Params: params}
-			data, err := node.Coder.Encode(f)
+			data, err := encodeTagged(node.Coder, f)
 			if err != nil {
 				return
 			}
@@ -127,7 +165,7 @@ func (node *ZNode) Start(scriptPath string) {
 		})
 		ipt.Bind("Set", func(host string, pid int, name string, params interface{}) (err error) {
 			f := &ZFunc{Name: name, Params: params}
-			data, e := node.Coder.Encode(f)
+			data, e := encodeTagged(node.Coder, f)
 			if e != nil {
 				return e
 			}
@@ -139,6 +177,23 @@ func (node *ZNode) Start(scriptPath string) {
 			}
 			return
 		})
+		ipt.Bind("SetOnKey", func(key, name string, params interface{}) (err error) {
+			owner, ok := node.ring.Owner(key)
+			if !ok {
+				return ErrNoOwner
+			}
+			f := &ZFunc{Name: name, Params: params}
+			data, err := encodeTagged(node.Coder, f)
+			if err != nil {
+				return
+			}
+			for _, conn := range node.conns {
+				if err = conn.Set(owner, data); err != nil {
+					return
+				}
+			}
+			return
+		})
 
 		return nil
 	}
@@ -146,25 +201,90 @@ func (node *ZNode) Start(scriptPath string) {
 }
 
 func (node *ZNode) loop() {
-	if node.Coder == nil {
-		var j JSON
-		node.Coder = j
-	}
 	for data := range node.watcher {
 		var fn ZFunc
-		if err := node.Coder.Decode(data, &fn); err != nil {
+		if err := decodeTagged(data, &fn); err != nil {
 			node.err(err)
 			continue
 		}
+		if int(fn.PastCount) > len(fn.Past) {
+			node.err(ErrBadPastCount)
+			continue
+		}
+		if node.causal {
+			deliveries, err := node.dag.Offer(ContentID(data), fn)
+			if err != nil {
+				node.err(err)
+				continue
+			}
+			for _, d := range deliveries {
+				node.observe(d.id)
+				node.dispatchOrCall(d.fn)
+			}
+			continue
+		}
+		node.dispatchOrCall(fn)
+	}
+}
+
+// dispatchOrCall runs fn, replying on fn.ReplyTo if set.
+func (node *ZNode) dispatchOrCall(fn ZFunc) {
+	if fn.ReplyTo != "" {
+		go node.dispatch(fn)
+	} else {
 		go node.Call(fn.Name, fn.Params)
 	}
 }
 
-func (node *ZNode) Close() {
-	emap := node.iptPool.Free()
-	for _, err := range emap {
-		node.err(err)
+// EnableCausal turns causal ordering on or off. While on, SetOnWire
+// stamps outgoing messages with the producer's causal frontier and the
+// dispatch loop withholds a message until every id in its Past has
+// been delivered.
+func (node *ZNode) EnableCausal(enable bool) {
+	node.causal = enable
+	if enable && node.dag == nil {
+		node.dag = NewMiniDag()
+	}
+}
+
+// PurgeOlderThan drops causal bookkeeping older than age. It is a
+// no-op when causal ordering has never been enabled.
+func (node *ZNode) PurgeOlderThan(age time.Duration) {
+	if node.dag != nil {
+		node.dag.PurgeOlderThan(age)
 	}
+}
+
+// stampCausal records f's producer-side causal frontier when causal
+// ordering is enabled.
+func (node *ZNode) stampCausal(f *ZFunc) {
+	if !node.causal {
+		return
+	}
+	node.lastMu.Lock()
+	f.Past = node.lastIDs
+	f.PastCount = node.lastCount
+	node.lastMu.Unlock()
+}
+
+// observe extends the producer-side causal frontier with id, keeping
+// at most the two most recently observed ids.
+func (node *ZNode) observe(id [16]byte) {
+	if !node.causal {
+		return
+	}
+	node.lastMu.Lock()
+	defer node.lastMu.Unlock()
+	if node.lastCount < 2 {
+		node.lastIDs[node.lastCount] = id
+		node.lastCount++
+		return
+	}
+	node.lastIDs[0] = node.lastIDs[1]
+	node.lastIDs[1] = id
+}
+
+func (node *ZNode) Close() {
 	for _, c := range node.conns {
 		if err := c.Close(); err != nil {
 			node.err(err)
@@ -187,7 +307,7 @@ func (node *ZNode) watch(file string) {
 		node.w.Add(1)
 		defer node.w.Done()
 		for i := 0; i < MaxErrorCount; i++ {
-			if err := c.Watch(file, node.watcher); err != nil {
+			if err := c.Watch(file, node.watcher, nil); err != nil {
 				if err == ErrConnection {
 					break
 				}
@@ -200,18 +320,130 @@ func (node *ZNode) watch(file string) {
 }
 
 func (node *ZNode) Call(name string, params interface{}) {
+	if _, err := node.call(name, params); err != nil {
+		node.err(err)
+	}
+}
+
+// call invokes name, through the bound Go func map or, failing that,
+// the Lua script pool, and returns whatever the callee returned.
+// iptpool.ScriptIpt has no way to read back a script's return value,
+// so a name resolved through the Lua pool is fire-and-forget: result
+// is always nil for it, same as for a Go func bound with no return
+// value at all.
+func (node *ZNode) call(name string, params interface{}) (result interface{}, err error) {
 	if _, ok := node.fmap[name]; ok {
-		if _, err := node.fmap.Call(name, params); err != nil {
-			node.err(err)
+		values, err := node.fmap.Call(name, params)
+		if err != nil {
+			return nil, err
 		}
-		return
+		return unpackCallResult(values)
 	}
 	ipt := node.iptPool.Get()
 	defer node.iptPool.Put(ipt)
-	if err := ipt.Exec(name, params); err != nil {
+	return nil, ipt.Exec(name, params)
+}
+
+// unpackCallResult turns the reflect.Values a bound Go func returned
+// into a plain (result, error) pair: a trailing error return is split
+// off as err, and whatever remains becomes result - nil if nothing
+// else was returned, the bare value if exactly one was, or a []interface{}
+// if more than one was.
+func unpackCallResult(values []reflect.Value) (result interface{}, err error) {
+	if len(values) > 0 {
+		last := values[len(values)-1]
+		if last.Type().Implements(errorType) {
+			if !last.IsNil() {
+				err = last.Interface().(error)
+			}
+			values = values[:len(values)-1]
+		}
+	}
+	switch len(values) {
+	case 0:
+		return nil, err
+	case 1:
+		return values[0].Interface(), err
+	default:
+		out := make([]interface{}, len(values))
+		for i, v := range values {
+			out[i] = v.Interface()
+		}
+		return out, err
+	}
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// dispatch invokes fn and writes its result back to fn.ReplyTo, turning
+// fn into an RPC response rather than a fire-and-forget call.
+func (node *ZNode) dispatch(fn ZFunc) {
+	result, err := node.call(fn.Name, fn.Params)
+	if err != nil {
 		node.err(err)
 		return
 	}
+	data, err := encodeTagged(node.Coder, result)
+	if err != nil {
+		node.err(err)
+		return
+	}
+	for _, conn := range node.conns {
+		if err := conn.Set(fn.ReplyTo, data); err != nil {
+			node.err(err)
+		}
+	}
+}
+
+// Request calls name on the node identified by host/pid with params,
+// and blocks for up to timeout for the reply. It is the synchronous
+// counterpart to the fire-and-forget SetOnWire/SetOnSelf/Set bindings.
+func (node *ZNode) Request(host string, pid int, name string, params interface{}, timeout time.Duration) (result interface{}, err error) {
+	reqID := atomic.AddUint64(&node.reqSeq, 1)
+	// Key the reply path on this requesting node (nodeFile is
+	// Root/node/<hostname>/<pid>), so requesters never share one.
+	self := strings.TrimPrefix(node.nodeFile, Root+"/node/")
+	replyTo := fmt.Sprintf(ReplyFile, self[:strings.LastIndex(self, "/")], os.Getpid(), reqID)
+
+	// replyTo is unique to this call, so once it's served its purpose -
+	// win, lose or time out - nothing will ever watch it again: tear
+	// down whatever the backend cached for it instead of leaking a
+	// watch stream or subscription for the life of the Conn.
+	defer func() {
+		for _, conn := range node.conns {
+			conn.Unwatch(replyTo)
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	replies := make(chan []byte, 1)
+	for _, conn := range node.conns {
+		go conn.Watch(replyTo, replies, done)
+	}
+
+	f := &ZFunc{Name: name, Params: params, ReplyTo: replyTo, ReqID: reqID}
+	data, err := encodeTagged(node.Coder, f)
+	if err != nil {
+		return nil, err
+	}
+	nodeFile := MakeNode(NodeFile, host, pid)
+	for _, conn := range node.conns {
+		if err = conn.Set(nodeFile, data); err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case raw := <-replies:
+		if err := decodeTagged(raw, &result); err != nil {
+			return nil, err
+		}
+		return result, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
 }
 
 func (node *ZNode) watchSelf() {
@@ -223,3 +455,82 @@ func (node *ZNode) watchWire() {
 		go node.watch(v)
 	}
 }
+
+// watchMembers keeps node.ring in sync with the set of currently
+// registered nodes. InfoDir holds one flat entry per registered node
+// (the "hostname!pid" leaf Register creates under infoFile), so a
+// children-watch on InfoDir - which Conn implementations recognise by
+// its trailing slash - delivers the JSON-encoded list of currently
+// registered info paths on every join/leave; only the members that
+// actually changed are rehashed.
+func (node *ZNode) watchMembers() {
+	ch := make(chan []byte, QUEUE_SIZE)
+	for _, c := range node.conns {
+		node.w.Add(1)
+		go func(c Conn) {
+			defer node.w.Done()
+			for i := 0; i < MaxErrorCount; i++ {
+				if err := c.Watch(InfoDir, ch, nil); err != nil {
+					if err == ErrConnection {
+						break
+					}
+					node.err(err)
+					continue
+				}
+				i = 0
+			}
+		}(c)
+	}
+	go func() {
+		for data := range ch {
+			var infoPaths []string
+			if err := (JSON{}).Decode(data, &infoPaths); err != nil {
+				node.err(err)
+				continue
+			}
+			members := make([]string, 0, len(infoPaths))
+			for _, p := range infoPaths {
+				if m, ok := nodeFileForInfo(p); ok {
+					members = append(members, m)
+				}
+			}
+			node.updateRing(members)
+		}
+	}()
+}
+
+// nodeFileForInfo turns an InfoDir entry (.../hostname!pid) into the
+// NodeFile path messages for that node are actually delivered to.
+func nodeFileForInfo(infoPath string) (string, bool) {
+	leaf := infoPath
+	if i := strings.LastIndex(infoPath, "/"); i >= 0 {
+		leaf = infoPath[i+1:]
+	}
+	i := strings.LastIndex(leaf, "!")
+	if i < 0 {
+		return "", false
+	}
+	pid, err := strconv.Atoi(leaf[i+1:])
+	if err != nil {
+		return "", false
+	}
+	return MakeNode(NodeFile, leaf[:i], pid), true
+}
+
+// updateRing diffs current against the members known so far, adding
+// and removing only the affected ring entries.
+func (node *ZNode) updateRing(current []string) {
+	seen := make(map[string]bool, len(current))
+	for _, m := range current {
+		seen[m] = true
+		if !node.members[m] {
+			node.ring.Add(m)
+		}
+	}
+	for m := range node.members {
+		if !seen[m] {
+			node.ring.Remove(m)
+		}
+	}
+	node.members = seen
+}
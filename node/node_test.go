@@ -0,0 +1,182 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal in-memory Conn: Set delivers straight to a
+// goroutine already blocked in Watch on the same file, or, if none is
+// waiting yet, leaves the value pending for the next Watch call - a
+// mailbox rather than pure pub/sub, so Set and Watch can race in
+// either order the way they do against a real backend.
+type fakeConn struct {
+	mu      sync.Mutex
+	subs    map[string][]chan []byte
+	pending map[string][]byte
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		subs:    make(map[string][]chan []byte),
+		pending: make(map[string][]byte),
+	}
+}
+
+func (c *fakeConn) Register(file string, data []byte) error { return nil }
+
+func (c *fakeConn) Set(file string, data []byte) error {
+	c.mu.Lock()
+	if chans := c.subs[file]; len(chans) > 0 {
+		ch := chans[0]
+		c.subs[file] = chans[1:]
+		c.mu.Unlock()
+		ch <- data
+		return nil
+	}
+	c.pending[file] = data
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) Watch(file string, watcher chan []byte, done <-chan struct{}) error {
+	c.mu.Lock()
+	if data, ok := c.pending[file]; ok {
+		delete(c.pending, file)
+		c.mu.Unlock()
+		watcher <- data
+		return nil
+	}
+	ch := make(chan []byte, 1)
+	c.subs[file] = append(c.subs[file], ch)
+	c.mu.Unlock()
+	select {
+	case data := <-ch:
+		watcher <- data
+		return nil
+	case <-done:
+		return nil
+	}
+}
+
+func (c *fakeConn) Unwatch(file string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.subs, file)
+	delete(c.pending, file)
+	return nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func TestRequestDispatchRoundTrip(t *testing.T) {
+	n := New("host")
+	n.Coder = JSON{}
+	fc := newFakeConn()
+	if err := n.AddConn(fc); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Bind("echo", func(s string) (string, error) {
+		return "echo:" + s, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the peer host->pid is addressed to: watch its node file,
+	// decode whatever Request publishes there, and dispatch it.
+	nodeFile := MakeNode(NodeFile, "host", os.Getpid())
+	go func() {
+		raw := make(chan []byte, 1)
+		if err := fc.Watch(nodeFile, raw, nil); err != nil {
+			t.Error(err)
+			return
+		}
+		var fn ZFunc
+		if err := decodeTagged(<-raw, &fn); err != nil {
+			t.Error(err)
+			return
+		}
+		n.dispatch(fn)
+	}()
+
+	result, err := n.Request("host", os.Getpid(), "echo", "hi", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "echo:hi" {
+		t.Fatalf("Request result = %v, want %q", result, "echo:hi")
+	}
+}
+
+// TestRequestWithoutStartDoesNotPanic guards against Request on a
+// ZNode that was never Start()ed, e.g. a pure RPC client: node.Coder
+// used to default to JSON only inside loop(), which only Start
+// launches, so decoding a reply here used to nil-deref.
+func TestRequestWithoutStartDoesNotPanic(t *testing.T) {
+	n := New("host")
+	fc := newFakeConn()
+	if err := n.AddConn(fc); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Bind("echo", func(s string) (string, error) {
+		return "echo:" + s, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	nodeFile := MakeNode(NodeFile, "host", os.Getpid())
+	go func() {
+		raw := make(chan []byte, 1)
+		if err := fc.Watch(nodeFile, raw, nil); err != nil {
+			t.Error(err)
+			return
+		}
+		var fn ZFunc
+		if err := decodeTagged(<-raw, &fn); err != nil {
+			t.Error(err)
+			return
+		}
+		n.dispatch(fn)
+	}()
+
+	result, err := n.Request("host", os.Getpid(), "echo", "hi", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "echo:hi" {
+		t.Fatalf("Request result = %v, want %q", result, "echo:hi")
+	}
+}
+
+func TestRequestTimesOutAndCancelsWatch(t *testing.T) {
+	n := New("host")
+	n.Coder = JSON{}
+	fc := newFakeConn()
+	if err := n.AddConn(fc); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err := n.Request("host", os.Getpid(), "nobody-listens", "hi", 10*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("Request with no reply = %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Request took %v, far past its 10ms timeout", elapsed)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for file := range fc.subs {
+		if strings.HasPrefix(file, Root+"/reply/") {
+			t.Fatalf("Request left its reply watch on %s in place after timing out", file)
+		}
+	}
+}
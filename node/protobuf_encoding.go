@@ -0,0 +1,77 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// TagProtobuf is the codec tag Protobuf registers itself under.
+const TagProtobuf byte = 0x02
+
+const (
+	anyFieldTypeURL = protowire.Number(1)
+	anyFieldValue   = protowire.Number(2)
+)
+
+// Protobuf is an Encoding that wraps v in a google.protobuf.Any-style
+// envelope (type_url + bytes value), so ZFunc.Params can stay
+// polymorphic without a .proto message per producer. The envelope
+// itself is genuine protobuf wire format; the wrapped value is JSON so
+// arbitrary Go values round-trip without code generation.
+type Protobuf struct{}
+
+func (Protobuf) Encode(v interface{}) ([]byte, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	typeURL := fmt.Sprintf("type.googleapis.com/znode.%T", v)
+	var b []byte
+	b = protowire.AppendTag(b, anyFieldTypeURL, protowire.BytesType)
+	b = protowire.AppendString(b, typeURL)
+	b = protowire.AppendTag(b, anyFieldValue, protowire.BytesType)
+	b = protowire.AppendBytes(b, value)
+	return b, nil
+}
+
+func (Protobuf) Decode(data []byte, v interface{}) error {
+	var value []byte
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch num {
+		case anyFieldValue:
+			b, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value = b
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return json.Unmarshal(value, v)
+}
+
+func (Protobuf) Tag() byte { return TagProtobuf }
+
+func init() {
+	if err := RegisterEncoding("protobuf", Protobuf{}); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultReplicas is the number of virtual nodes placed on the ring for
+// each registered member when none is given to NewHashRing.
+const DefaultReplicas = 160
+
+// HashRing is a consistent-hash ring over the node paths currently
+// registered under Root + "/info/". Add/Remove only touch the virtual
+// node points belonging to the affected member, so membership changes
+// rehash incrementally rather than rebuilding the whole ring.
+type HashRing struct {
+	mu       sync.RWMutex
+	replicas int
+	points   []uint32
+	members  map[uint32]string
+}
+
+// NewHashRing creates an empty ring with replicas virtual nodes per
+// member (DefaultReplicas if replicas <= 0).
+func NewHashRing(replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	return &HashRing{
+		replicas: replicas,
+		members:  make(map[uint32]string),
+	}
+}
+
+func hashKey(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Add places member's virtual nodes on the ring. Adding an already
+// present member is a no-op for each of its existing points.
+func (r *HashRing) Add(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i < r.replicas; i++ {
+		h := hashKey(fmt.Sprintf("%s#%d", member, i))
+		r.members[h] = member
+		r.insert(h)
+	}
+}
+
+// Remove takes member's virtual nodes off the ring.
+func (r *HashRing) Remove(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i < r.replicas; i++ {
+		h := hashKey(fmt.Sprintf("%s#%d", member, i))
+		delete(r.members, h)
+		r.remove(h)
+	}
+}
+
+func (r *HashRing) insert(h uint32) {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i < len(r.points) && r.points[i] == h {
+		return
+	}
+	r.points = append(r.points, 0)
+	copy(r.points[i+1:], r.points[i:])
+	r.points[i] = h
+}
+
+func (r *HashRing) remove(h uint32) {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i < len(r.points) && r.points[i] == h {
+		r.points = append(r.points[:i], r.points[i+1:]...)
+	}
+}
+
+// Owner returns the member owning key, and false if the ring is empty.
+func (r *HashRing) Owner(key string) (string, bool) {
+	owners := r.Owners(key, 1)
+	if len(owners) == 0 {
+		return "", false
+	}
+	return owners[0], true
+}
+
+// Owners returns the top-n distinct successors of key on the ring, in
+// walk order, for replicated dispatch. It returns fewer than n members
+// if the ring doesn't have that many distinct members yet.
+func (r *HashRing) Owners(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n <= 0 || len(r.points) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	seen := make(map[string]bool, n)
+	owners := make([]string, 0, n)
+	for c := 0; c < len(r.points) && len(owners) < n; c++ {
+		m := r.members[r.points[(start+c)%len(r.points)]]
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		owners = append(owners, m)
+	}
+	return owners
+}
@@ -0,0 +1,68 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import "testing"
+
+func TestHashRingOwnerEmpty(t *testing.T) {
+	r := NewHashRing(8)
+	if _, ok := r.Owner("key"); ok {
+		t.Fatal("Owner on an empty ring should report no owner")
+	}
+}
+
+func TestHashRingAddRemove(t *testing.T) {
+	r := NewHashRing(8)
+	r.Add("a")
+	r.Add("b")
+	r.Add("c")
+
+	owner, ok := r.Owner("some-key")
+	if !ok {
+		t.Fatal("Owner should find a member once the ring is non-empty")
+	}
+	if owner != "a" && owner != "b" && owner != "c" {
+		t.Fatalf("Owner returned unknown member %q", owner)
+	}
+
+	r.Remove(owner)
+	owners := r.Owners("some-key", 3)
+	for _, m := range owners {
+		if m == owner {
+			t.Fatalf("Remove(%q) left its virtual nodes on the ring", owner)
+		}
+	}
+}
+
+func TestHashRingOwnersDistinct(t *testing.T) {
+	r := NewHashRing(8)
+	r.Add("a")
+	r.Add("b")
+	r.Add("c")
+
+	owners := r.Owners("some-key", 3)
+	if len(owners) != 3 {
+		t.Fatalf("Owners(3) = %v, want 3 distinct members", owners)
+	}
+	seen := make(map[string]bool)
+	for _, m := range owners {
+		if seen[m] {
+			t.Fatalf("Owners returned %q twice: %v", m, owners)
+		}
+		seen[m] = true
+	}
+}
+
+func TestHashRingOwnersFewerThanRequested(t *testing.T) {
+	r := NewHashRing(8)
+	r.Add("a")
+	r.Add("b")
+
+	owners := r.Owners("some-key", 5)
+	if len(owners) != 2 {
+		t.Fatalf("Owners(5) on a 2-member ring = %v, want 2", owners)
+	}
+}
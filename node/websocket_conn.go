@@ -0,0 +1,277 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsPingPeriod = 30 * time.Second
+	wsSubBuffer  = QUEUE_SIZE
+)
+
+// wsOp names the operation carried by a wsFrame.
+type wsOp string
+
+const (
+	wsOpRegister wsOp = "register"
+	wsOpSet      wsOp = "set"
+	wsOpWatch    wsOp = "watch"
+	wsOpUnwatch  wsOp = "unwatch"
+	wsOpValue    wsOp = "value"
+)
+
+// wsFrame is the message exchanged between a WebSocketConn and the
+// znode-hub: Register/Set publish Data at Path, Watch subscribes to
+// Path, Unwatch drops that subscription, and the hub replies with Op
+// "value" frames for every Set it has seen on a watched Path.
+type wsFrame struct {
+	Op   wsOp   `json:"op"`
+	Path string `json:"path"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// WebSocketConn is a Conn backed by a znode-hub server, letting nodes
+// on disjoint networks join a wire without sharing a ZK/etcd cluster.
+type WebSocketConn struct {
+	url string
+
+	writeMu sync.Mutex
+	conn    *websocket.Conn
+	closed  bool
+
+	subMu sync.Mutex
+	subs  map[string]chan []byte
+
+	errMu     sync.Mutex
+	errCounts map[string]int
+}
+
+// NewWebSocketConn dials the hub at url (a ws:// or wss:// address).
+func NewWebSocketConn(url string) (c *WebSocketConn, err error) {
+	c = &WebSocketConn{
+		url:       url,
+		subs:      make(map[string]chan []byte),
+		errCounts: make(map[string]int),
+	}
+	if err = c.dial(); err != nil {
+		return nil, err
+	}
+	go c.readLoop()
+	go c.pinger()
+	return c, nil
+}
+
+func (c *WebSocketConn) dial() error {
+	conn, _, err := websocket.DefaultDialer.Dial(c.url, nil)
+	if err != nil {
+		return err
+	}
+	conn.SetPongHandler(func(string) error { return nil })
+	c.writeMu.Lock()
+	if c.closed {
+		c.writeMu.Unlock()
+		conn.Close()
+		return ErrConnection
+	}
+	c.conn = conn
+	c.writeMu.Unlock()
+	return nil
+}
+
+// socket returns the current connection, guarded by the same mutex
+// dial()/Close() use to swap/close it.
+func (c *WebSocketConn) socket() (*websocket.Conn, bool) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn, c.closed
+}
+
+func (c *WebSocketConn) Register(file string, data []byte) error {
+	return c.retry(file, c.send(wsFrame{Op: wsOpRegister, Path: file, Data: data}))
+}
+
+func (c *WebSocketConn) Set(file string, data []byte) error {
+	return c.retry(file, c.send(wsFrame{Op: wsOpSet, Path: file, Data: data}))
+}
+
+// Watch subscribes to file if it isn't already and blocks until the
+// hub delivers one value, pushing it onto watcher and returning, or
+// until done is closed (a nil done never fires), in which case it
+// returns nil without unsubscribing - another caller may still be
+// watching the same file.
+func (c *WebSocketConn) Watch(file string, watcher chan []byte, done <-chan struct{}) error {
+	ch := c.subscribe(file)
+	if err := c.send(wsFrame{Op: wsOpWatch, Path: file}); err != nil {
+		return c.retry(file, err)
+	}
+	select {
+	case data, ok := <-ch:
+		if !ok {
+			return c.retry(file, ErrConnection)
+		}
+		watcher <- data
+		return c.retry(file, nil)
+	case <-done:
+		return nil
+	}
+}
+
+// Unwatch retires file's cached subscription, if any, and tells the hub
+// to stop sending this conn updates for it, so the next Watch call on
+// file resubscribes from scratch instead of the map entry (and the
+// hub's matching one) living for the life of the WebSocketConn.
+func (c *WebSocketConn) Unwatch(file string) error {
+	c.subMu.Lock()
+	_, ok := c.subs[file]
+	delete(c.subs, file)
+	c.subMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return c.retry(file, c.send(wsFrame{Op: wsOpUnwatch, Path: file}))
+}
+
+func (c *WebSocketConn) Close() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *WebSocketConn) subscribe(file string) chan []byte {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	ch, ok := c.subs[file]
+	if !ok {
+		ch = make(chan []byte, wsSubBuffer)
+		c.subs[file] = ch
+	}
+	return ch
+}
+
+func (c *WebSocketConn) send(f wsFrame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return ErrConnection
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// readLoop dispatches frames from the hub to the matching subscription
+// channel and reconnects (re-subscribing to every known path) on error.
+// It stops without reconnecting once Close has been called.
+func (c *WebSocketConn) readLoop() {
+	for {
+		conn, closed := c.socket()
+		if closed {
+			return
+		}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if _, closed := c.socket(); closed {
+				return
+			}
+			if c.reconnect() != nil {
+				return
+			}
+			continue
+		}
+		var f wsFrame
+		if err := json.Unmarshal(data, &f); err != nil {
+			continue
+		}
+		if f.Op != wsOpValue {
+			continue
+		}
+		if ch := c.subscribe(f.Path); ch != nil {
+			select {
+			case ch <- f.Data:
+			default:
+			}
+		}
+	}
+}
+
+func (c *WebSocketConn) reconnect() error {
+	for i := 0; i < MaxErrorCount; i++ {
+		if _, closed := c.socket(); closed {
+			return ErrConnection
+		}
+		time.Sleep(wsBackoff(i + 1))
+		if err := c.dial(); err != nil {
+			continue
+		}
+		c.resubscribeAll()
+		return nil
+	}
+	return ErrConnection
+}
+
+func (c *WebSocketConn) resubscribeAll() {
+	c.subMu.Lock()
+	paths := make([]string, 0, len(c.subs))
+	for p := range c.subs {
+		paths = append(paths, p)
+	}
+	c.subMu.Unlock()
+	for _, p := range paths {
+		c.send(wsFrame{Op: wsOpWatch, Path: p})
+	}
+}
+
+func (c *WebSocketConn) pinger() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.writeMu.Lock()
+		if c.closed {
+			c.writeMu.Unlock()
+			return
+		}
+		err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
+		c.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// retry tracks consecutive failures per file and turns err into
+// ErrConnection once MaxErrorCount is reached for that file, the same
+// per-path accounting EtcdConn.retry uses, so a failure burst on one
+// path doesn't trip ErrConnection for unrelated Set/Watch calls.
+func (c *WebSocketConn) retry(file string, err error) error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if err == nil {
+		delete(c.errCounts, file)
+		return nil
+	}
+	c.errCounts[file]++
+	if c.errCounts[file] >= MaxErrorCount {
+		return ErrConnection
+	}
+	return err
+}
+
+func wsBackoff(attempt int) time.Duration {
+	d := time.Duration(attempt*attempt) * 100 * time.Millisecond
+	if d > 5*time.Second {
+		d = 5 * time.Second
+	}
+	return d
+}
@@ -0,0 +1,150 @@
+// Copyright 2012 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// ZkConn is the ZooKeeper-backed Conn.
+type ZkConn struct {
+	conn *zk.Conn
+}
+
+// NewZkConn dials the given ZooKeeper ensemble.
+func NewZkConn(endpoints []string, timeout time.Duration) (c *ZkConn, err error) {
+	conn, _, err := zk.Connect(endpoints, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &ZkConn{conn: conn}, nil
+}
+
+func (c *ZkConn) Register(file string, data []byte) (err error) {
+	c.mkdirAll(file)
+	_, err = c.conn.Create(file, data, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	return
+}
+
+func (c *ZkConn) Set(file string, data []byte) (err error) {
+	if _, err = c.conn.Set(file, data, -1); err == zk.ErrNoNode {
+		c.mkdirAll(file)
+		_, err = c.conn.Create(file, data, 0, zk.WorldACL(zk.PermAll))
+	}
+	return
+}
+
+// Watch delivers a single update at file, or returns nil early once
+// done is closed (a nil done never fires). A file ending in "/" is
+// treated as a directory: Watch delivers the JSON-encoded list of its
+// full child paths whenever a child is added or removed, which is how
+// ZNode discovers registered members under InfoDir. Otherwise file is
+// routinely watched before anything has ever been Set on it (a fresh
+// wire, node file or reply path), so a missing node is not treated as
+// terminal: we wait on ExistsW for it to be created and then read it in
+// the same call; any other event returns nil so the caller's retry loop
+// calls Watch again.
+func (c *ZkConn) Watch(file string, watcher chan []byte, done <-chan struct{}) error {
+	if strings.HasSuffix(file, "/") {
+		return c.watchChildren(file, watcher, done)
+	}
+	exists, _, existsEvents, err := c.conn.ExistsW(file)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		select {
+		case ev := <-existsEvents:
+			if ev.Err != nil {
+				return ev.Err
+			}
+			if ev.Type != zk.EventNodeCreated {
+				return nil
+			}
+		case <-done:
+			return nil
+		}
+	}
+	data, _, events, err := c.conn.GetW(file)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return nil
+		}
+		return err
+	}
+	watcher <- data
+	select {
+	case ev := <-events:
+		return ev.Err
+	case <-done:
+		return nil
+	}
+}
+
+// Unwatch is a no-op: ZkConn caches nothing per path, re-issuing a
+// fresh ExistsW/GetW (or ChildrenW) on every Watch call, so there is
+// nothing to retire.
+func (c *ZkConn) Unwatch(file string) error { return nil }
+
+// watchChildren delivers the JSON-encoded list of dir's full child
+// paths. dir is watched before any node has ever registered under it,
+// so if it does not exist yet watchChildren creates it and returns nil
+// without delivering anything, for the caller to call Watch again.
+func (c *ZkConn) watchChildren(dir string, watcher chan []byte, done <-chan struct{}) error {
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		dir = "/"
+	}
+	children, _, events, err := c.conn.ChildrenW(dir)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			c.ensureDir(dir)
+			return nil
+		}
+		return err
+	}
+	paths := make([]string, len(children))
+	for i, name := range children {
+		paths[i] = dir + "/" + name
+	}
+	data, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+	watcher <- data
+	select {
+	case ev := <-events:
+		return ev.Err
+	case <-done:
+		return nil
+	}
+}
+
+// ensureDir creates dir itself as a persistent node, ignoring the
+// error if it already exists.
+func (c *ZkConn) ensureDir(dir string) {
+	c.conn.Create(dir, nil, 0, zk.WorldACL(zk.PermAll))
+}
+
+func (c *ZkConn) Close() error {
+	c.conn.Close()
+	return nil
+}
+
+// mkdirAll creates the parent path of file as persistent nodes,
+// ignoring nodes that already exist.
+func (c *ZkConn) mkdirAll(file string) {
+	parts := strings.Split(strings.Trim(file, "/"), "/")
+	path := ""
+	for _, p := range parts[:len(parts)-1] {
+		path += "/" + p
+		c.conn.Create(path, nil, 0, zk.WorldACL(zk.PermAll))
+	}
+}